@@ -0,0 +1,108 @@
+package protobson
+
+import (
+	"reflect"
+	"testing"
+
+	pb_test "github.com/tesspib/protobson/test"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"google.golang.org/protobuf/proto"
+)
+
+// codecSwitch is a bsoncodec.ValueEncoder/ValueDecoder that forwards to
+// whichever *protobufCodec it currently holds. It lets the benchmarks below
+// swap in a codec with a fresh (empty) typeCache between iterations without
+// rebuilding the bsoncodec.Registry each time, so that registry-construction
+// cost — unrelated to what typeCache caches — doesn't leak into the
+// measurement.
+type codecSwitch struct {
+	pc *protobufCodec
+}
+
+func (s *codecSwitch) EncodeValue(ectx bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	return s.pc.EncodeValue(ectx, vw, val)
+}
+
+func (s *codecSwitch) DecodeValue(dctx bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	return s.pc.DecodeValue(dctx, vr, val)
+}
+
+func newSwitchableRegistry() (*bsoncodec.Registry, *codecSwitch) {
+	sw := &codecSwitch{pc: &protobufCodec{}}
+	typ := reflect.TypeOf((*proto.Message)(nil)).Elem()
+	rb := bson.NewRegistryBuilder()
+	reg := rb.RegisterHookEncoder(typ, sw).RegisterHookDecoder(typ, sw).Build()
+	return reg, sw
+}
+
+// BenchmarkEncodeValueColdCache gives the codecSwitch a brand new
+// *protobufCodec (and thus an empty typeCache) on every iteration, simulating
+// a caller that never reuses a codec across calls. The registry itself is
+// built once, outside the loop, so the measured delta against
+// BenchmarkEncodeValueWarmCache is attributable to typeCache alone.
+func BenchmarkEncodeValueColdCache(b *testing.B) {
+	msg := &pb_test.SimpleMessage{StringField: "foo", Int32Field: 32525, BoolField: true}
+	reg, sw := newSwitchableRegistry()
+	for i := 0; i < b.N; i++ {
+		sw.pc = &protobufCodec{}
+		if _, err := bson.MarshalWithRegistry(reg, msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkEncodeValueWarmCache reuses a single codec (and its typeCache)
+// across every iteration, so every field's reflect.Type is resolved once and
+// read from the cache thereafter.
+func BenchmarkEncodeValueWarmCache(b *testing.B) {
+	msg := &pb_test.SimpleMessage{StringField: "foo", Int32Field: 32525, BoolField: true}
+	reg, _ := newSwitchableRegistry()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bson.MarshalWithRegistry(reg, msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func largeRepeatedSubMessagePayload() *pb_test.MessageWithRepeatedSubMessage {
+	items := make([]*pb_test.SimpleMessage, 1000)
+	for i := range items {
+		items[i] = &pb_test.SimpleMessage{
+			StringField: "foo",
+			Int32Field:  int32(i),
+			BoolField:   i%2 == 0,
+		}
+	}
+	return &pb_test.MessageWithRepeatedSubMessage{StringField: "large", SimpleMessage: items}
+}
+
+// BenchmarkEncodeValueLargeRepeatedSubMessageColdCache is
+// BenchmarkEncodeValueColdCache's counterpart for a message with 1000
+// repeated submessages, all of which share the same per-field typeCache
+// entries of SimpleMessage.
+func BenchmarkEncodeValueLargeRepeatedSubMessageColdCache(b *testing.B) {
+	msg := largeRepeatedSubMessagePayload()
+	reg, sw := newSwitchableRegistry()
+	for i := 0; i < b.N; i++ {
+		sw.pc = &protobufCodec{}
+		if _, err := bson.MarshalWithRegistry(reg, msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkEncodeValueLargeRepeatedSubMessageWarmCache is
+// BenchmarkEncodeValueWarmCache's counterpart for the same large payload.
+func BenchmarkEncodeValueLargeRepeatedSubMessageWarmCache(b *testing.B) {
+	msg := largeRepeatedSubMessagePayload()
+	reg, _ := newSwitchableRegistry()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bson.MarshalWithRegistry(reg, msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package protobson
+
+import (
+	"reflect"
+	"sync"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// typeCache memoizes, per message field, the two pieces of a field's codec
+// "plan" that are cheap to get wrong on every call but expensive to redo on
+// every call: the reflect.Type used to encode/decode it, and (on the encode
+// side) its precomputed BSON element name. Entries are keyed by the field's
+// containing message and number (and, for a reflect.Type of a message-kind
+// field, by whether the sample value is a dynamicpb.Message), and filled in
+// lazily on first use.
+//
+// Deriving the reflect.Type from a FieldDescriptor requires a concrete sample
+// protoreflect.Value for message-kind fields (to recover whether the field
+// holds a generated or dynamicpb message), which is why it can't simply be
+// precomputed eagerly from the descriptor alone ahead of the first call.
+//
+// Proto descriptors are immutable once loaded, the Go type backing a given
+// message field never changes across generated instances of that message
+// type, nor across dynamicpb instances of it (the key tells the two apart), and a
+// protobufCodec's NameStrategy is fixed at construction and never mutated
+// afterward, so a cached entry of either kind remains valid for the lifetime
+// of the codec that owns it. Resolving the bsoncodec.ValueEncoder/ValueDecoder
+// for a type is intentionally left to bsoncodec.Registry itself, which
+// already caches its own lookups; caching it again here risks going stale if
+// a codec were ever reused across registries.
+type typeCache struct {
+	entries sync.Map // map[typeCacheKey]reflect.Type
+	names   sync.Map // map[typeCacheKey]string
+}
+
+type typeCacheKey struct {
+	message protoreflect.FullName
+	field   protoreflect.FieldNumber
+	dynamic bool
+}
+
+// typeFor returns the cached reflect.Type for fd, computing and storing it
+// from v on the first call for this field.
+func (c *typeCache) typeFor(fd protoreflect.FieldDescriptor, v *protoreflect.Value) reflect.Type {
+	key := typeCacheKey{message: fd.ContainingMessage().FullName(), field: fd.Number()}
+	if fd.Message() != nil && !fd.IsMap() {
+		_, key.dynamic = v.Message().Interface().(*dynamicpb.Message)
+	}
+	if t, ok := c.entries.Load(key); ok {
+		return t.(reflect.Type)
+	}
+	t := reflectTypeFromProtoReflectValue(fd, v)
+	actual, _ := c.entries.LoadOrStore(key, t)
+	return actual.(reflect.Type)
+}
+
+// nameFor returns the cached BSON element name for fd under strategy,
+// computing and storing it via strategy.Encode on the first call for this
+// field, so that a NameStrategy that formats or allocates (FieldNumberNames
+// included, via fmt.Sprintf) only does so once per field rather than on every
+// single EncodeValue call.
+func (c *typeCache) nameFor(fd protoreflect.FieldDescriptor, strategy NameStrategy) string {
+	key := typeCacheKey{message: fd.ContainingMessage().FullName(), field: fd.Number()}
+	if n, ok := c.names.Load(key); ok {
+		return n.(string)
+	}
+	n := strategy.Encode(fd)
+	actual, _ := c.names.LoadOrStore(key, n)
+	return actual.(string)
+}
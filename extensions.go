@@ -0,0 +1,56 @@
+package protobson
+
+import (
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// ExtensionResolver resolves proto2 extension fields declared against a
+// message type, by field number (for the default FieldNumberNames strategy)
+// or by full name (for NameStrategy implementations, such as ProtoFieldNames
+// and JSONFieldNames, that encode extensions using their full name).
+// protoregistry.GlobalTypes satisfies this interface and is used by default.
+type ExtensionResolver interface {
+	FindExtensionByNumber(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionType, error)
+	FindExtensionByName(field protoreflect.FullName) (protoreflect.ExtensionType, error)
+}
+
+func (pc *protobufCodec) resolver() ExtensionResolver {
+	if pc.extensionResolver != nil {
+		return pc.extensionResolver
+	}
+	return protoregistry.GlobalTypes
+}
+
+// resolveExtension returns the FieldDescriptor for num if it falls within a
+// declared extension range of md and the codec's ExtensionResolver has a
+// registered extension for it. It returns nil otherwise, in which case num
+// should be treated as an ordinary unknown field.
+func (pc *protobufCodec) resolveExtension(md protoreflect.MessageDescriptor, num protoreflect.FieldNumber) protoreflect.FieldDescriptor {
+	if !md.ExtensionRanges().Has(num) {
+		return nil
+	}
+	xt, err := pc.resolver().FindExtensionByNumber(md.FullName(), num)
+	if err != nil {
+		return nil
+	}
+	return xt.TypeDescriptor()
+}
+
+// resolveExtensionByName returns the FieldDescriptor for the extension named
+// fullName, if the codec's ExtensionResolver has one registered that extends
+// md. It returns nil otherwise. This is consulted for element names that a
+// non-default NameStrategy failed to resolve, since ProtoFieldNames and
+// JSONFieldNames both encode extension fields using their full name rather
+// than a field number.
+func (pc *protobufCodec) resolveExtensionByName(md protoreflect.MessageDescriptor, fullName protoreflect.FullName) protoreflect.FieldDescriptor {
+	xt, err := pc.resolver().FindExtensionByName(fullName)
+	if err != nil {
+		return nil
+	}
+	fd := xt.TypeDescriptor()
+	if fd.ContainingMessage().FullName() != md.FullName() {
+		return nil
+	}
+	return fd
+}
@@ -0,0 +1,95 @@
+package protobson
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// buildExtendableMessage constructs, purely from descriptor protos, a proto2
+// message with a declared extension range and a matching extension field,
+// since the repo's generated test messages don't include one.
+func buildExtendableMessage(t *testing.T) (protoreflect.MessageDescriptor, protoreflect.ExtensionType) {
+	t.Helper()
+
+	label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	strType := descriptorpb.FieldDescriptorProto_TYPE_STRING
+
+	fdProto := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("protobson/extension_test.proto"),
+		Package: proto.String("protobson.extensiontest"),
+		Syntax:  proto.String("proto2"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("ExtendableMessage"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{Name: proto.String("string_field"), Number: proto.Int32(1), Label: &label, Type: &strType},
+				},
+				ExtensionRange: []*descriptorpb.DescriptorProto_ExtensionRange{
+					{Start: proto.Int32(100), End: proto.Int32(200)},
+				},
+			},
+		},
+		Extension: []*descriptorpb.FieldDescriptorProto{
+			{
+				Name:     proto.String("ext_string_field"),
+				Number:   proto.Int32(100),
+				Label:    &label,
+				Type:     &strType,
+				Extendee: proto.String(".protobson.extensiontest.ExtendableMessage"),
+			},
+		},
+	}
+
+	file, err := protodesc.NewFile(fdProto, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatalf("protodesc.NewFile error = %v", err)
+	}
+
+	msgDesc := file.Messages().ByName("ExtendableMessage")
+	extType := dynamicpb.NewExtensionType(file.Extensions().ByName("ext_string_field"))
+	return msgDesc, extType
+}
+
+func TestDecodeValueProto2Extension(t *testing.T) {
+	msgDesc, extType := buildExtendableMessage(t)
+
+	resolver := &protoregistry.Types{}
+	if err := resolver.RegisterExtension(extType); err != nil {
+		t.Fatalf("RegisterExtension error = %v", err)
+	}
+
+	typ := reflect.TypeOf((*proto.Message)(nil)).Elem()
+	codec := NewCodec(WithExtensionResolver(resolver))
+	rb := bson.NewRegistryBuilder()
+	reg := rb.RegisterHookDecoder(typ, codec).RegisterHookEncoder(typ, codec).Build()
+
+	in := dynamicpb.NewMessage(msgDesc)
+	in.Set(msgDesc.Fields().ByNumber(1), protoreflect.ValueOfString("foo"))
+	in.Set(extType.TypeDescriptor(), protoreflect.ValueOfString("bar"))
+
+	b, err := bson.MarshalWithRegistry(reg, proto.Message(in))
+	if err != nil {
+		t.Fatalf("bson.MarshalWithRegistry error = %v", err)
+	}
+
+	out := proto.Message(dynamicpb.NewMessage(msgDesc))
+	if err = bson.UnmarshalWithRegistry(reg, b, &out); err != nil {
+		t.Fatalf("bson.UnmarshalWithRegistry error = %v", err)
+	}
+
+	got := out.ProtoReflect().Get(extType.TypeDescriptor()).String()
+	if got != "bar" {
+		t.Errorf("extension field = %q, want %q", got, "bar")
+	}
+	if !proto.Equal(in, out) {
+		t.Errorf("failed: in=%#q, out=%#q", in, out)
+	}
+}
@@ -0,0 +1,84 @@
+package protobson
+
+import (
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// NameStrategy determines the BSON element name used for a Protobuf message
+// field, in both directions.
+type NameStrategy interface {
+	// Encode returns the BSON element name to use when writing fd.
+	Encode(fd protoreflect.FieldDescriptor) string
+	// Decode returns the field of md that the element name corresponds to,
+	// or nil if name does not match this strategy's naming scheme.
+	Decode(name string, md protoreflect.MessageDescriptor) protoreflect.FieldDescriptor
+}
+
+// FieldNumberNames is the default NameStrategy. It encodes fields as
+// pb_field_<number>, so that stored documents survive field renames.
+type FieldNumberNames struct{}
+
+func (FieldNumberNames) Encode(fd protoreflect.FieldDescriptor) string {
+	return FieldNumberToElementName(fd.Number())
+}
+
+func (FieldNumberNames) Decode(name string, md protoreflect.MessageDescriptor) protoreflect.FieldDescriptor {
+	num, ok := fieldNumberFromElementName(name)
+	if !ok {
+		return nil
+	}
+	return md.Fields().ByNumber(num)
+}
+
+// ProtoFieldNames encodes fields using their Protobuf source name
+// (FieldDescriptor.Name), e.g. "string_field". This is convenient for ad-hoc
+// queries and aggregations, at the cost of breaking stored documents across
+// a field rename. Extension fields are encoded using their full name to keep
+// them unambiguous across packages.
+type ProtoFieldNames struct{}
+
+func (ProtoFieldNames) Encode(fd protoreflect.FieldDescriptor) string {
+	if fd.IsExtension() {
+		return string(fd.FullName())
+	}
+	return string(fd.Name())
+}
+
+func (ProtoFieldNames) Decode(name string, md protoreflect.MessageDescriptor) protoreflect.FieldDescriptor {
+	return md.Fields().ByName(protoreflect.Name(name))
+}
+
+// JSONFieldNames encodes fields using their JSON name (FieldDescriptor.JSONName),
+// e.g. "stringField", matching protojson's convention.
+type JSONFieldNames struct{}
+
+func (JSONFieldNames) Encode(fd protoreflect.FieldDescriptor) string {
+	if fd.IsExtension() {
+		return string(fd.FullName())
+	}
+	return fd.JSONName()
+}
+
+func (JSONFieldNames) Decode(name string, md protoreflect.MessageDescriptor) protoreflect.FieldDescriptor {
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		if fd := fields.Get(i); fd.JSONName() == name {
+			return fd
+		}
+	}
+	return nil
+}
+
+func fieldNumberFromElementName(name string) (protoreflect.FieldNumber, bool) {
+	if !strings.HasPrefix(name, fieldPrefix) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(name, fieldPrefix))
+	if err != nil {
+		return 0, false
+	}
+	return protoreflect.FieldNumber(n), true
+}
@@ -0,0 +1,117 @@
+package protobson
+
+import (
+	"reflect"
+	"testing"
+
+	pb_test "github.com/tesspib/protobson/test"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func newRegistry(codec bsoncodec.ValueCodec) *bsoncodec.Registry {
+	typ := reflect.TypeOf((*proto.Message)(nil)).Elem()
+	rb := bson.NewRegistryBuilder()
+	return rb.RegisterHookDecoder(typ, codec).RegisterHookEncoder(typ, codec).Build()
+}
+
+func TestNameStrategyProtoFieldNames(t *testing.T) {
+	reg := newRegistry(NewCodec(WithNameStrategy(ProtoFieldNames{})))
+
+	in := &pb_test.SimpleMessage{StringField: "foo", Int32Field: 32525}
+	b, err := bson.MarshalWithRegistry(reg, in)
+	if err != nil {
+		t.Fatalf("bson.MarshalWithRegistry error = %v", err)
+	}
+	if v := bson.Raw(b).Lookup("string_field"); v.Value == nil {
+		t.Fatalf("expected element %q, got %v", "string_field", bson.Raw(b))
+	}
+
+	out := &pb_test.SimpleMessage{}
+	if err = bson.UnmarshalWithRegistry(reg, b, &out); err != nil {
+		t.Fatalf("bson.UnmarshalWithRegistry error = %v", err)
+	}
+	if !proto.Equal(in, out) {
+		t.Errorf("failed: in=%#q, out=%#q", in, out)
+	}
+}
+
+func TestNameStrategyJSONFieldNames(t *testing.T) {
+	reg := newRegistry(NewCodec(WithNameStrategy(JSONFieldNames{})))
+
+	in := &pb_test.SimpleMessage{StringField: "foo"}
+	b, err := bson.MarshalWithRegistry(reg, in)
+	if err != nil {
+		t.Fatalf("bson.MarshalWithRegistry error = %v", err)
+	}
+	if v := bson.Raw(b).Lookup("stringField"); v.Value == nil {
+		t.Fatalf("expected element %q, got %v", "stringField", bson.Raw(b))
+	}
+
+	out := &pb_test.SimpleMessage{}
+	if err = bson.UnmarshalWithRegistry(reg, b, &out); err != nil {
+		t.Fatalf("bson.UnmarshalWithRegistry error = %v", err)
+	}
+	if !proto.Equal(in, out) {
+		t.Errorf("failed: in=%#q, out=%#q", in, out)
+	}
+}
+
+func TestNameStrategyFallsBackToFieldNumberNames(t *testing.T) {
+	legacy := newRegistry(NewCodec())
+	in := &pb_test.SimpleMessage{StringField: "foo"}
+	b, err := bson.MarshalWithRegistry(legacy, in)
+	if err != nil {
+		t.Fatalf("bson.MarshalWithRegistry error = %v", err)
+	}
+
+	reg := newRegistry(NewCodec(WithNameStrategy(ProtoFieldNames{}, FieldNumberNames{})))
+	out := &pb_test.SimpleMessage{}
+	if err = bson.UnmarshalWithRegistry(reg, b, &out); err != nil {
+		t.Fatalf("bson.UnmarshalWithRegistry error = %v", err)
+	}
+	if !proto.Equal(in, out) {
+		t.Errorf("failed to fall back to pb_field_N naming: in=%#q, out=%#q", in, out)
+	}
+}
+
+// TestNameStrategyProtoFieldNamesExtension guards against ProtoFieldNames
+// failing to resolve extension fields on decode: Encode names them by full
+// name, so decoding must fall back to the configured ExtensionResolver by that
+// same full name, rather than only consulting md.Fields() (which never
+// contains extensions). JSONFieldNames names extensions the same way, but is
+// not exercised here.
+func TestNameStrategyProtoFieldNamesExtension(t *testing.T) {
+	msgDesc, extType := buildExtendableMessage(t)
+
+	resolver := &protoregistry.Types{}
+	if err := resolver.RegisterExtension(extType); err != nil {
+		t.Fatalf("RegisterExtension error = %v", err)
+	}
+
+	reg := newRegistry(NewCodec(WithNameStrategy(ProtoFieldNames{}), WithExtensionResolver(resolver)))
+
+	in := dynamicpb.NewMessage(msgDesc)
+	in.Set(msgDesc.Fields().ByNumber(1), protoreflect.ValueOfString("foo"))
+	in.Set(extType.TypeDescriptor(), protoreflect.ValueOfString("bar"))
+
+	b, err := bson.MarshalWithRegistry(reg, proto.Message(in))
+	if err != nil {
+		t.Fatalf("bson.MarshalWithRegistry error = %v", err)
+	}
+	if v := bson.Raw(b).Lookup(string(extType.TypeDescriptor().FullName())); v.Value == nil {
+		t.Fatalf("expected element %q, got %v", extType.TypeDescriptor().FullName(), bson.Raw(b))
+	}
+
+	out := proto.Message(dynamicpb.NewMessage(msgDesc))
+	if err = bson.UnmarshalWithRegistry(reg, b, &out); err != nil {
+		t.Fatalf("bson.UnmarshalWithRegistry error = %v", err)
+	}
+	if !proto.Equal(in, out) {
+		t.Errorf("failed: in=%#q, out=%#q", in, out)
+	}
+}
@@ -0,0 +1,130 @@
+package protobson
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const oneofDiscriminatorPrefix = "pb_oneof_"
+
+// oneofDiscriminatorName returns the BSON element name used to record which
+// case of od is active.
+func oneofDiscriminatorName(od protoreflect.OneofDescriptor) string {
+	return oneofDiscriminatorPrefix + string(od.Name())
+}
+
+func isOneofDiscriminatorName(name string) bool {
+	return strings.HasPrefix(name, oneofDiscriminatorPrefix)
+}
+
+// encodeOneofDiscriminators writes one pb_oneof_<name> element per
+// non-synthetic oneof group of msg that has an active case, recording that
+// case's field number so that a reader can tell which case is active
+// without projecting every case's field against the descriptor. Synthetic
+// oneofs (the proto3 "optional" keyword's implementation detail) are
+// skipped, since they only ever have a single member.
+func encodeOneofDiscriminators(dw bsonrw.DocumentWriter, msg protoreflect.Message) error {
+	oneofs := msg.Descriptor().Oneofs()
+	for i := 0; i < oneofs.Len(); i++ {
+		od := oneofs.Get(i)
+		if od.IsSynthetic() {
+			continue
+		}
+		fd := msg.WhichOneof(od)
+		if fd == nil {
+			continue
+		}
+		vw, err := dw.WriteDocumentElement(oneofDiscriminatorName(od))
+		if err != nil {
+			return err
+		}
+		if err = vw.WriteInt32(int32(fd.Number())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// oneofDiscriminators is the set of pb_oneof_<name> markers read so far
+// during a decode, recording which field number each names.
+type oneofDiscriminators map[protoreflect.Name]protoreflect.FieldNumber
+
+// read decodes a pb_oneof_<name> element named name from vr into ds.
+func (ds oneofDiscriminators) read(name string, vr bsonrw.ValueReader) error {
+	n, err := vr.ReadInt32()
+	if err != nil {
+		return err
+	}
+	oneofName := strings.TrimPrefix(name, oneofDiscriminatorPrefix)
+	ds[protoreflect.Name(oneofName)] = protoreflect.FieldNumber(n)
+	return nil
+}
+
+// allowed reports whether fd should be decoded given the discriminators
+// observed so far. A oneof member field with no matching discriminator is
+// always allowed, since the discriminator is optional metadata; one with a
+// discriminator present is only allowed if it names this field, so that a
+// document with multiple (erroneously present) case keys for the same
+// oneof group is resolved by the discriminator rather than by write order.
+func (ds oneofDiscriminators) allowed(fd protoreflect.FieldDescriptor) bool {
+	od := fd.ContainingOneof()
+	if od == nil || od.IsSynthetic() {
+		return true
+	}
+	want, ok := ds[od.Name()]
+	if !ok {
+		return true
+	}
+	return want == fd.Number()
+}
+
+// bufferedElement is a document element whose raw BSON value has been read
+// out of a ValueReader for later replay, once every discriminator in the
+// document is known.
+type bufferedElement struct {
+	name string
+	t    bsontype.Type
+	data []byte
+}
+
+// decodeDocumentWithDiscriminators decodes dr into msg in two passes: the
+// first buffers every element and records every pb_oneof_<name> marker
+// regardless of where in the document it appears; the second decodes the
+// buffered elements against the now-complete discriminator set. This is
+// necessary because a discriminator is only useful if it is known before the
+// case fields it gates are applied, and a document is not guaranteed to have
+// been written by this codec (which always emits discriminators first) — a
+// tool that canonicalizes BSON keys alphabetically, for instance, would sort
+// pb_field_* ahead of pb_oneof_*.
+func (pc *protobufCodec) decodeDocumentWithDiscriminators(dctx bsoncodec.DecodeContext, dr bsonrw.DocumentReader, msg protoreflect.Message) error {
+	discriminators := oneofDiscriminators{}
+	var elements []bufferedElement
+	for name, vr, err := dr.ReadElement(); err != bsonrw.ErrEOD; name, vr, err = dr.ReadElement() {
+		if err != nil {
+			return err
+		}
+		if isOneofDiscriminatorName(name) {
+			if err = discriminators.read(name, vr); err != nil {
+				return err
+			}
+			continue
+		}
+		t, data, err := bsonrw.Copier{}.CopyValueToBytes(vr)
+		if err != nil {
+			return err
+		}
+		elements = append(elements, bufferedElement{name: name, t: t, data: data})
+	}
+
+	for _, el := range elements {
+		vr := bsonrw.NewBSONValueReader(el.t, el.data)
+		if err := pc.decodeElement(dctx, msg, el.name, vr, discriminators); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package protobson
+
+import (
+	pb_test "github.com/tesspib/protobson/test"
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/proto"
+	"testing"
+)
+
+func TestOneofDiscriminatorRoundTrip(t *testing.T) {
+	reg := newRegistry(NewCodec(WithOneofDiscriminator(true)))
+
+	in := &pb_test.MessageWithOneof{
+		StringField: "baz",
+		OneofField:  &pb_test.MessageWithOneof_Int32OneofField{Int32OneofField: 3132},
+	}
+	b, err := bson.MarshalWithRegistry(reg, in)
+	if err != nil {
+		t.Fatalf("bson.MarshalWithRegistry error = %v", err)
+	}
+	if v := bson.Raw(b).Lookup("pb_oneof_oneof_field"); v.Value == nil {
+		t.Fatalf("expected discriminator element, got %v", bson.Raw(b))
+	}
+
+	out := &pb_test.MessageWithOneof{}
+	if err = bson.UnmarshalWithRegistry(reg, b, &out); err != nil {
+		t.Fatalf("bson.UnmarshalWithRegistry error = %v", err)
+	}
+	if !proto.Equal(in, out) {
+		t.Errorf("failed: in=%#q, out=%#q", in, out)
+	}
+}
+
+func TestOneofDiscriminatorResolvesConflictingCasesDiscriminatorFirst(t *testing.T) {
+	reg := newRegistry(NewCodec(WithOneofDiscriminator(true)))
+
+	// Simulate a document with two (erroneously) present oneof case keys by
+	// decoding a hand-built BSON document: the discriminator names the
+	// int32 case, so the string case that also appears must be ignored.
+	in := bson.D{
+		{Key: "pb_field_1", Value: "baz"},
+		{Key: "pb_oneof_oneof_field", Value: int32(3)},
+		{Key: "pb_field_3", Value: int32(3132)},
+		{Key: "pb_field_2", Value: "stale"},
+	}
+	b, err := bson.Marshal(in)
+	if err != nil {
+		t.Fatalf("bson.Marshal error = %v", err)
+	}
+
+	out := &pb_test.MessageWithOneof{}
+	if err = bson.UnmarshalWithRegistry(reg, b, &out); err != nil {
+		t.Fatalf("bson.UnmarshalWithRegistry error = %v", err)
+	}
+
+	want := &pb_test.MessageWithOneof{
+		StringField: "baz",
+		OneofField:  &pb_test.MessageWithOneof_Int32OneofField{Int32OneofField: 3132},
+	}
+	if !proto.Equal(want, out) {
+		t.Errorf("failed: want=%#q, out=%#q", want, out)
+	}
+}
+
+// TestOneofDiscriminatorResolvesConflictingCasesDiscriminatorLast is the same
+// scenario as TestOneofDiscriminatorResolvesConflictingCasesDiscriminatorFirst,
+// except the discriminator is placed after both conflicting case keys, as a
+// document produced by a tool that canonicalizes BSON keys (e.g.
+// alphabetically) might do. A single forward streaming pass would apply both
+// conflicting cases in write order before ever consulting the discriminator,
+// so this only passes with a decode that buffers the document first.
+func TestOneofDiscriminatorResolvesConflictingCasesDiscriminatorLast(t *testing.T) {
+	reg := newRegistry(NewCodec(WithOneofDiscriminator(true)))
+
+	in := bson.D{
+		{Key: "pb_field_1", Value: "baz"},
+		{Key: "pb_field_3", Value: int32(3132)},
+		{Key: "pb_field_2", Value: "stale"},
+		{Key: "pb_oneof_oneof_field", Value: int32(3)},
+	}
+	b, err := bson.Marshal(in)
+	if err != nil {
+		t.Fatalf("bson.Marshal error = %v", err)
+	}
+
+	out := &pb_test.MessageWithOneof{}
+	if err = bson.UnmarshalWithRegistry(reg, b, &out); err != nil {
+		t.Fatalf("bson.UnmarshalWithRegistry error = %v", err)
+	}
+
+	want := &pb_test.MessageWithOneof{
+		StringField: "baz",
+		OneofField:  &pb_test.MessageWithOneof_Int32OneofField{Int32OneofField: 3132},
+	}
+	if !proto.Equal(want, out) {
+		t.Errorf("failed: want=%#q, out=%#q", want, out)
+	}
+}
@@ -0,0 +1,60 @@
+package protobson
+
+// CodecOption configures the behavior of a codec returned by NewCodec.
+type CodecOption func(*protobufCodec)
+
+// WithDropUnknownFields controls whether elements that do not correspond to a
+// known field of the target message are preserved across a decode/encode round
+// trip (the default) or silently stripped.
+//
+// By default, unrecognized pb_field_N elements encountered during DecodeValue
+// are stashed in the message's unknown field set via Message.SetUnknown, and
+// re-emitted by EncodeValue via Message.GetUnknown. Passing true disables this
+// and restores the old behavior of discarding unrecognized elements.
+func WithDropUnknownFields(drop bool) CodecOption {
+	return func(pc *protobufCodec) {
+		pc.dropUnknownFields = drop
+	}
+}
+
+// WithWellKnownTypes controls whether well-known protobuf message types
+// (Timestamp, Duration, Any, the wrapper types, Struct/Value/ListValue,
+// FieldMask, Empty) are encoded idiomatically in BSON rather than as a
+// generic pb_field_N document. It is enabled by default; pass false to
+// restore the generic field-number encoding for these types.
+func WithWellKnownTypes(enabled bool) CodecOption {
+	return func(pc *protobufCodec) {
+		pc.wellKnownTypesDisabled = !enabled
+	}
+}
+
+// WithExtensionResolver sets the resolver used to look up proto2 extension
+// fields whose number does not belong to any regular field of the target
+// message. It defaults to protoregistry.GlobalTypes; pass a scoped
+// *protoregistry.Types to resolve only a known set of extensions.
+func WithExtensionResolver(resolver ExtensionResolver) CodecOption {
+	return func(pc *protobufCodec) {
+		pc.extensionResolver = resolver
+	}
+}
+
+// WithNameStrategy sets the NameStrategy used to encode fields, used first
+// when decoding. Any fallback strategies are tried, in order, against
+// elements the primary strategy does not recognize, so that documents
+// written under a previous strategy can still be read. The default is
+// FieldNumberNames alone.
+func WithNameStrategy(primary NameStrategy, fallback ...NameStrategy) CodecOption {
+	return func(pc *protobufCodec) {
+		pc.nameStrategies = append([]NameStrategy{primary}, fallback...)
+	}
+}
+
+// WithOneofDiscriminator controls whether each oneof group is accompanied by
+// an extra pb_oneof_<name> element naming the field number of its active
+// case, so that a MongoDB query can filter on which case is active without
+// projecting every possible case field. It is disabled by default.
+func WithOneofDiscriminator(enabled bool) CodecOption {
+	return func(pc *protobufCodec) {
+		pc.oneofDiscriminator = enabled
+	}
+}
@@ -3,8 +3,6 @@ package protobson
 import (
 	"fmt"
 	"reflect"
-	"strconv"
-	"strings"
 
 	"go.mongodb.org/mongo-driver/bson/bsoncodec"
 	"go.mongodb.org/mongo-driver/bson/bsonrw"
@@ -17,13 +15,52 @@ const (
 	fieldPrefix = "pb_field_"
 )
 
-type protobufCodec struct{}
+type protobufCodec struct {
+	dropUnknownFields      bool
+	wellKnownTypesDisabled bool
+	extensionResolver      ExtensionResolver
+	nameStrategies         []NameStrategy
+	types                  typeCache
+	oneofDiscriminator     bool
+}
 
 // NewCodec returns a new instance of a BSON codec for Protobuf messages.
-// Messages are encoded using field numbers as document keys,
+// Messages are encoded using field numbers as document keys by default,
 // so that stored messages can survive field renames.
-func NewCodec() bsoncodec.ValueCodec {
-	return &protobufCodec{}
+func NewCodec(opts ...CodecOption) bsoncodec.ValueCodec {
+	pc := &protobufCodec{}
+	for _, opt := range opts {
+		opt(pc)
+	}
+	return pc
+}
+
+// primaryStrategy returns the NameStrategy used to encode fields, and tried
+// first when decoding. It defaults to FieldNumberNames.
+func (pc *protobufCodec) primaryStrategy() NameStrategy {
+	return pc.strategies()[0]
+}
+
+// strategies returns the ordered list of NameStrategy values consulted when
+// decoding, falling back to FieldNumberNames alone if none were configured.
+func (pc *protobufCodec) strategies() []NameStrategy {
+	if len(pc.nameStrategies) == 0 {
+		return []NameStrategy{FieldNumberNames{}}
+	}
+	return pc.nameStrategies
+}
+
+// decodeFieldDescriptor resolves the element name to a field of md by
+// trying each configured NameStrategy in order, so that documents written
+// with a different (but configured) strategy than the primary one still
+// decode correctly.
+func (pc *protobufCodec) decodeFieldDescriptor(md protoreflect.MessageDescriptor, name string) protoreflect.FieldDescriptor {
+	for _, s := range pc.strategies() {
+		if fd := s.Decode(name, md); fd != nil {
+			return fd
+		}
+	}
+	return nil
 }
 
 func (pc *protobufCodec) DecodeValue(dctx bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
@@ -31,67 +68,106 @@ func (pc *protobufCodec) DecodeValue(dctx bsoncodec.DecodeContext, vr bsonrw.Val
 		val.Set(reflect.New(val.Type().Elem()))
 	}
 
+	protoMsg := val.Interface().(proto.Message)
+	if !pc.wellKnownTypesDisabled {
+		if handled, err := pc.decodeWellKnownType(dctx, vr, protoMsg); handled {
+			return err
+		}
+	}
+
 	dr, err := vr.ReadDocument()
 	if err != nil {
 		return err
 	}
 
-	protoMsg := val.Interface().(proto.Message)
 	msg := protoMsg.ProtoReflect()
+	if pc.oneofDiscriminator {
+		// A single forward streaming pass cannot honor a discriminator that
+		// appears after the case fields it gates (e.g. in a document whose
+		// keys were sorted alphabetically by some other tool), so the whole
+		// document is buffered and replayed once every discriminator is known.
+		return pc.decodeDocumentWithDiscriminators(dctx, dr, msg)
+	}
 	for name, vr, err := dr.ReadElement(); err != bsonrw.ErrEOD; name, vr, err = dr.ReadElement() {
 		if err != nil {
 			return err
 		}
-		if !strings.HasPrefix(name, fieldPrefix) {
-			if err = vr.Skip(); err != nil {
-				return err
-			}
-			continue
-		}
-		n, err := strconv.Atoi(elementNameToFieldNumber(name))
-		if err != nil {
+		if err = pc.decodeElement(dctx, msg, name, vr, nil); err != nil {
 			return err
 		}
-		num := protoreflect.FieldNumber(n)
-		fd := msg.Descriptor().Fields().ByNumber(num)
-		// Skip elements representing a field that is not part of the Protobuf message.
-		if fd == nil {
-			if err = vr.Skip(); err != nil {
-				return err
-			}
-			continue
-		}
-		fv := msg.NewField(fd)
-
-		// This boolean is used to toggle previous message definition emulation
-		// in the decode function.
-		// Protobuf specification allows turning a repeated message field into a non-repeated one,
-		// and vice-versa, without breaking backwards compatibility.
-		// Therefore, if a message with an updated definition containing such change is given as target,
-		// a normal decode will fail, and another attempt is made with emulation of previous message definition
-		// (i.e. wrap and unwrap fields as necessary). This boolean is used to toggle emulation behavior.
-		var emulate bool
+	}
+	return nil
+}
 
-		// Try to decode without previous message definition emulation first.
-		if err = decodeField(dctx, vr, fd, &fv, emulate); err == nil {
-			msg.Set(fd, fv)
-			continue
+// decodeElement resolves name to a field of msg (consulting pc's configured
+// NameStrategy and ExtensionResolver, in that order) and decodes vr into it.
+// discriminators is nil unless oneof discriminators are enabled, in which
+// case a oneof member field whose group has a discriminator naming some
+// other case is skipped rather than set.
+func (pc *protobufCodec) decodeElement(dctx bsoncodec.DecodeContext, msg protoreflect.Message, name string, vr bsonrw.ValueReader, discriminators oneofDiscriminators) error {
+	fd := pc.decodeFieldDescriptor(msg.Descriptor(), name)
+	num, isNumbered := fieldNumberFromElementName(name)
+	if fd == nil && isNumbered {
+		// The number may belong to a proto2 extension rather than a regular field.
+		fd = pc.resolveExtension(msg.Descriptor(), num)
+	}
+	if fd == nil && !isNumbered {
+		// Under a non-default NameStrategy the name may be an extension's
+		// full name rather than a regular field's, since ProtoFieldNames
+		// and JSONFieldNames both encode extensions that way.
+		fd = pc.resolveExtensionByName(msg.Descriptor(), protoreflect.FullName(name))
+	}
+	if fd != nil && discriminators != nil && !discriminators.allowed(fd) {
+		return vr.Skip()
+	}
+	if fd == nil {
+		// The element does not correspond to a field known to this message's descriptor.
+		// Rather than discard it, stash it in the message's unknown field set so that
+		// it survives a decode/encode round trip through an older binary, unless the
+		// caller opted into strict stripping. This is only possible for elements keyed
+		// by field number: elements under a named NameStrategy that match no field are
+		// always dropped, since there is no field number to key them by.
+		if !isNumbered || pc.dropUnknownFields {
+			return vr.Skip()
 		}
-		origErr := err
+		return decodeUnknownField(msg, num, vr)
+	}
+	fv := msg.NewField(fd)
 
-		// Since initial decode attempt failed, try to decode again with previous message definition emulation.
-		// If this attempt also fails, the original decode error is returned.
-		emulate = true
-		if err = decodeField(dctx, vr, fd, &fv, emulate); err != nil {
-			return origErr
-		}
+	// This boolean is used to toggle previous message definition emulation
+	// in the decode function.
+	// Protobuf specification allows turning a repeated message field into a non-repeated one,
+	// and vice-versa, without breaking backwards compatibility.
+	// Therefore, if a message with an updated definition containing such change is given as target,
+	// a normal decode will fail, and another attempt is made with emulation of previous message definition
+	// (i.e. wrap and unwrap fields as necessary). This boolean is used to toggle emulation behavior.
+	var emulate bool
+
+	// Try to decode without previous message definition emulation first.
+	err := decodeField(dctx, vr, fd, &fv, emulate, &pc.types)
+	if err == nil {
 		msg.Set(fd, fv)
+		return nil
+	}
+	origErr := err
+
+	// Since initial decode attempt failed, try to decode again with previous message definition emulation.
+	// If this attempt also fails, the original decode error is returned.
+	emulate = true
+	if err = decodeField(dctx, vr, fd, &fv, emulate, &pc.types); err != nil {
+		return origErr
 	}
+	msg.Set(fd, fv)
 	return nil
 }
 
 func (pc *protobufCodec) EncodeValue(ectx bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
 	protoMsg := val.Interface().(proto.Message)
+	if !pc.wellKnownTypesDisabled {
+		if handled, err := pc.encodeWellKnownType(ectx, vw, protoMsg); handled {
+			return err
+		}
+	}
 	for val.Kind() != reflect.Struct {
 		val = val.Elem()
 	}
@@ -101,8 +177,16 @@ func (pc *protobufCodec) EncodeValue(ectx bsoncodec.EncodeContext, vw bsonrw.Val
 		return err
 	}
 
-	protoMsg.ProtoReflect().Range(func(fd protoreflect.FieldDescriptor, fv protoreflect.Value) bool {
-		if err = encodeField(ectx, dw, fd, &fv); err != nil {
+	msg := protoMsg.ProtoReflect()
+	if pc.oneofDiscriminator {
+		if err = encodeOneofDiscriminators(dw, msg); err != nil {
+			return err
+		}
+	}
+
+	strategy := pc.primaryStrategy()
+	msg.Range(func(fd protoreflect.FieldDescriptor, fv protoreflect.Value) bool {
+		if err = encodeField(ectx, dw, fd, &fv, pc.types.nameFor(fd, strategy), &pc.types); err != nil {
 			return false
 		}
 		return true
@@ -111,6 +195,12 @@ func (pc *protobufCodec) EncodeValue(ectx bsoncodec.EncodeContext, vw bsonrw.Val
 		return err
 	}
 
+	if !pc.dropUnknownFields {
+		if err = encodeUnknownFields(dw, msg.GetUnknown()); err != nil {
+			return err
+		}
+	}
+
 	return dw.WriteDocumentEnd()
 }
 
@@ -119,7 +209,7 @@ func FieldNumberToElementName(num protoreflect.FieldNumber) string {
 	return fmt.Sprintf("%v%v", fieldPrefix, num)
 }
 
-func decodeField(dctx bsoncodec.DecodeContext, vr bsonrw.ValueReader, fd protoreflect.FieldDescriptor, dst *protoreflect.Value, emul bool) error {
+func decodeField(dctx bsoncodec.DecodeContext, vr bsonrw.ValueReader, fd protoreflect.FieldDescriptor, dst *protoreflect.Value, emul bool, tc *typeCache) error {
 	var typ reflect.Type
 	var lv protoreflect.List
 	var mv protoreflect.Map
@@ -129,7 +219,7 @@ func decodeField(dctx bsoncodec.DecodeContext, vr bsonrw.ValueReader, fd protore
 		// - with emulation: the single value is wrapped in a list
 		lv = dst.List()
 		lev := lv.NewElement()
-		typ = reflectTypeFromProtoReflectValue(fd, &lev)
+		typ = tc.typeFor(fd, &lev)
 		if !emul {
 			typ = reflect.SliceOf(typ)
 		}
@@ -137,16 +227,16 @@ func decodeField(dctx bsoncodec.DecodeContext, vr bsonrw.ValueReader, fd protore
 		mv = dst.Map()
 		msg := dynamicpb.NewMessageType(fd.MapKey().ContainingMessage()).Zero()
 		mek, mev := msg.NewField(fd.MapKey()), mv.NewValue()
-		mekt, mevt := reflectTypeFromProtoReflectValue(fd.MapKey(), &mek), reflectTypeFromProtoReflectValue(fd.MapValue(), &mev)
+		mekt, mevt := tc.typeFor(fd.MapKey(), &mek), tc.typeFor(fd.MapValue(), &mev)
 		typ = reflect.MapOf(mekt, mevt)
 	} else if emul {
 		// Decoding a single-value field with emulation is done as follows:
 		// - for primitive type fields, the last input value is used
 		// - for message type fields, all input values are merged into a single value,
 		//   as per proto2 specification: https://developers.google.com/protocol-buffers/docs/proto#updating
-		typ = reflect.SliceOf(reflectTypeFromProtoReflectValue(fd, dst))
+		typ = reflect.SliceOf(tc.typeFor(fd, dst))
 	} else {
-		typ = reflectTypeFromProtoReflectValue(fd, dst)
+		typ = tc.typeFor(fd, dst)
 	}
 
 	dec, err := dctx.LookupDecoder(typ)
@@ -191,17 +281,13 @@ func decodeField(dctx bsoncodec.DecodeContext, vr bsonrw.ValueReader, fd protore
 	return nil
 }
 
-func elementNameToFieldNumber(name string) string {
-	return strings.Replace(name, fieldPrefix, "", 1)
-}
-
-func encodeField(ectx bsoncodec.EncodeContext, dw bsonrw.DocumentWriter, fd protoreflect.FieldDescriptor, src *protoreflect.Value) error {
+func encodeField(ectx bsoncodec.EncodeContext, dw bsonrw.DocumentWriter, fd protoreflect.FieldDescriptor, src *protoreflect.Value, name string, tc *typeCache) error {
 	var val reflect.Value
 	if fd.IsList() {
 		lv := src.List()
 		len := lv.Len()
 		lev := lv.NewElement()
-		typ := reflect.SliceOf(reflectTypeFromProtoReflectValue(fd, &lev))
+		typ := reflect.SliceOf(tc.typeFor(fd, &lev))
 		sv := reflect.MakeSlice(typ, len, len)
 		for i := 0; i < len; i++ {
 			lev := lv.Get(i)
@@ -212,7 +298,7 @@ func encodeField(ectx bsoncodec.EncodeContext, dw bsonrw.DocumentWriter, fd prot
 		pmap := src.Map()
 		msg := dynamicpb.NewMessageType(fd.MapKey().ContainingMessage()).Zero()
 		mek, mev := msg.NewField(fd.MapKey()), pmap.NewValue()
-		mekt, mevt := reflectTypeFromProtoReflectValue(fd.MapKey(), &mek), reflectTypeFromProtoReflectValue(fd.MapValue(), &mev)
+		mekt, mevt := tc.typeFor(fd.MapKey(), &mek), tc.typeFor(fd.MapValue(), &mev)
 		mv := reflect.MakeMapWithSize(reflect.MapOf(mekt, mevt), pmap.Len())
 		pmap.Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
 			kv := k.Value()
@@ -231,7 +317,7 @@ func encodeField(ectx bsoncodec.EncodeContext, dw bsonrw.DocumentWriter, fd prot
 		return err
 	}
 
-	vw, err := dw.WriteDocumentElement(FieldNumberToElementName(fd.Number()))
+	vw, err := dw.WriteDocumentElement(name)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,97 @@
+package protobson
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// unknownStashFieldNumber is the field number decodeUnknownField wraps its
+// stashed BSON elements in, so that encodeUnknownFields can tell them apart
+// from genuine protobuf wire-format unknown fields that may already be sharing
+// the same Message.GetUnknown() byte stream — e.g. fields a newer wire schema
+// added, left there by a proto.Unmarshal elsewhere in the pipeline before the
+// message ever reached this codec. 19000-19999 is reserved by the Protobuf
+// spec for implementation use: protoc rejects it for any field or extension
+// number, so no message built from a real .proto file can ever produce a
+// genuine unknown field under this number.
+const unknownStashFieldNumber protoreflect.FieldNumber = 19999
+
+// decodeUnknownField reads the raw BSON value behind vr and appends it to
+// msg's unknown field set, wrapped under unknownStashFieldNumber with a
+// synthesized wire tag. The original field number and the BSON type of the
+// value are recorded alongside its bytes so that encodeUnknownFields can both
+// recognize the entry as its own and reconstruct the original BSON value on a
+// later encode.
+func decodeUnknownField(msg protoreflect.Message, num protoreflect.FieldNumber, vr bsonrw.ValueReader) error {
+	t, data, err := bsonrw.Copier{}.CopyValueToBytes(vr)
+	if err != nil {
+		return err
+	}
+
+	payload := protowire.AppendVarint(nil, uint64(num))
+	payload = append(payload, byte(t))
+	payload = append(payload, data...)
+
+	b := msg.GetUnknown()
+	b = protowire.AppendTag(b, unknownStashFieldNumber, protowire.BytesType)
+	b = protowire.AppendBytes(b, payload)
+	msg.SetUnknown(b)
+	return nil
+}
+
+// encodeUnknownFields walks a message's raw unknown field set and re-emits the
+// entries previously stashed there by decodeUnknownField as document elements.
+// Every other entry is left untouched and not reflected into the BSON
+// document: it may be a genuine protobuf wire-format unknown field (e.g. one
+// a newer wire schema added), and there is no wire-to-BSON type mapping to
+// fall back on for those — nor, critically, any way to tell a BytesType entry
+// like that apart from one of protobson's own stashed values without the
+// unknownStashFieldNumber tag, so treating it as one would risk handing
+// arbitrary protobuf bytes to bsonrw.Copier.
+func encodeUnknownFields(dw bsonrw.DocumentWriter, raw []byte) error {
+	for len(raw) > 0 {
+		num, wtyp, n := protowire.ConsumeTag(raw)
+		if n < 0 {
+			return fmt.Errorf("protobson: malformed unknown field set: %w", protowire.ParseError(n))
+		}
+		raw = raw[n:]
+
+		if num != unknownStashFieldNumber || wtyp != protowire.BytesType {
+			_, n = protowire.ConsumeFieldValue(num, wtyp, raw)
+			if n < 0 {
+				return fmt.Errorf("protobson: malformed unknown field set: %w", protowire.ParseError(n))
+			}
+			raw = raw[n:]
+			continue
+		}
+
+		payload, n := protowire.ConsumeBytes(raw)
+		if n < 0 {
+			return fmt.Errorf("protobson: malformed unknown field set: %w", protowire.ParseError(n))
+		}
+		raw = raw[n:]
+
+		origNum, n := protowire.ConsumeVarint(payload)
+		if n < 0 {
+			return fmt.Errorf("protobson: malformed unknown field stash entry: %w", protowire.ParseError(n))
+		}
+		payload = payload[n:]
+		if len(payload) == 0 {
+			continue
+		}
+		t, data := bsontype.Type(payload[0]), payload[1:]
+
+		vw, err := dw.WriteDocumentElement(FieldNumberToElementName(protoreflect.FieldNumber(origNum)))
+		if err != nil {
+			return err
+		}
+		if err = bsonrw.Copier{}.CopyValueFromBytes(vw, t, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
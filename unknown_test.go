@@ -0,0 +1,127 @@
+package protobson
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	pb_test "github.com/tesspib/protobson/test"
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestUnknownFieldsPreservedByDefault(t *testing.T) {
+	typ := reflect.TypeOf((*proto.Message)(nil)).Elem()
+	rb := bson.NewRegistryBuilder()
+	reg := rb.RegisterHookDecoder(typ, NewCodec()).RegisterHookEncoder(typ, NewCodec()).Build()
+
+	in, err := bson.Marshal(bson.D{
+		{Key: "pb_field_1", Value: "foo"},
+		{Key: "pb_field_99", Value: "mystery"},
+	})
+	if err != nil {
+		t.Fatalf("bson.Marshal error = %v", err)
+	}
+
+	out := &pb_test.SimpleMessage{}
+	if err = bson.UnmarshalWithRegistry(reg, in, &out); err != nil {
+		t.Fatalf("bson.UnmarshalWithRegistry error = %v", err)
+	}
+	if out.StringField != "foo" {
+		t.Errorf("StringField = %q, want %q", out.StringField, "foo")
+	}
+
+	b, err := bson.MarshalWithRegistry(reg, out)
+	if err != nil {
+		t.Fatalf("bson.MarshalWithRegistry error = %v", err)
+	}
+
+	var value string
+	if err = bson.Raw(b).Lookup("pb_field_99").Unmarshal(&value); err != nil {
+		t.Fatalf("unknown field pb_field_99 did not survive round trip: %v", err)
+	}
+	if value != "mystery" {
+		t.Errorf("pb_field_99 = %q, want %q", value, "mystery")
+	}
+}
+
+func TestUnknownFieldsDroppedWhenConfigured(t *testing.T) {
+	typ := reflect.TypeOf((*proto.Message)(nil)).Elem()
+	codec := NewCodec(WithDropUnknownFields(true))
+	rb := bson.NewRegistryBuilder()
+	reg := rb.RegisterHookDecoder(typ, codec).RegisterHookEncoder(typ, codec).Build()
+
+	in, err := bson.Marshal(bson.D{
+		{Key: "pb_field_1", Value: "foo"},
+		{Key: "pb_field_99", Value: "mystery"},
+	})
+	if err != nil {
+		t.Fatalf("bson.Marshal error = %v", err)
+	}
+
+	out := &pb_test.SimpleMessage{}
+	if err = bson.UnmarshalWithRegistry(reg, in, &out); err != nil {
+		t.Fatalf("bson.UnmarshalWithRegistry error = %v", err)
+	}
+
+	b, err := bson.MarshalWithRegistry(reg, out)
+	if err != nil {
+		t.Fatalf("bson.MarshalWithRegistry error = %v", err)
+	}
+	if v := bson.Raw(b).Lookup("pb_field_99"); v.Value != nil {
+		t.Errorf("pb_field_99 should have been dropped, got %v", v)
+	}
+}
+
+// TestGenuineWireUnknownFieldSurvivesEncode guards against encodeUnknownFields
+// misinterpreting genuine protobuf wire-format unknown fields — the ones
+// proto.Unmarshal leaves on Message.GetUnknown() when reading bytes from a
+// newer wire schema, as opposed to the BSON elements decodeUnknownField
+// stashes there itself. A wire-format BytesType entry (the common case: a
+// string, submessage, or packed repeated field) must not be handed to
+// bsonrw.Copier as if its bytes were one of protobson's own stashed values.
+func TestGenuineWireUnknownFieldSurvivesEncode(t *testing.T) {
+	in := &pb_test.SimpleMessage{StringField: "foo", Int32Field: 32525}
+	wire, err := proto.Marshal(in)
+	if err != nil {
+		t.Fatalf("proto.Marshal error = %v", err)
+	}
+
+	// Append a field number no generated message in this test package
+	// declares, with a BytesType payload (a string), simulating a field a
+	// newer wire schema added that this binary doesn't know about.
+	const unknownFieldNumber = 999
+	wire = protowire.AppendTag(wire, unknownFieldNumber, protowire.BytesType)
+	wire = protowire.AppendString(wire, "stowaway")
+
+	out := &pb_test.SimpleMessage{}
+	if err = proto.Unmarshal(wire, out); err != nil {
+		t.Fatalf("proto.Unmarshal error = %v", err)
+	}
+	wantUnknown := append([]byte(nil), out.ProtoReflect().GetUnknown()...)
+	if len(wantUnknown) == 0 {
+		t.Fatal("expected proto.Unmarshal to leave a genuine unknown field on the message")
+	}
+
+	typ := reflect.TypeOf((*proto.Message)(nil)).Elem()
+	rb := bson.NewRegistryBuilder()
+	reg := rb.RegisterHookDecoder(typ, NewCodec()).RegisterHookEncoder(typ, NewCodec()).Build()
+
+	b, err := bson.MarshalWithRegistry(reg, out)
+	if err != nil {
+		t.Fatalf("bson.MarshalWithRegistry error = %v", err)
+	}
+	if v := bson.Raw(b).Lookup("pb_field_999"); v.Value != nil {
+		t.Errorf("genuine wire unknown field should not have been mapped into BSON, got %v", v)
+	}
+	var stringField string
+	if err = bson.Raw(b).Lookup("pb_field_1").Unmarshal(&stringField); err != nil || stringField != "foo" {
+		t.Errorf("StringField = %q, err = %v, want %q", stringField, err, "foo")
+	}
+
+	if !bytes.Equal(out.ProtoReflect().GetUnknown(), wantUnknown) {
+		t.Errorf("genuine unknown field bytes were mutated by EncodeValue: got %x, want %x",
+			out.ProtoReflect().GetUnknown(), wantUnknown)
+	}
+}
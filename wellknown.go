@@ -0,0 +1,600 @@
+package protobson
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// wkNanosField is the sidecar element used to preserve sub-millisecond
+// precision when a Timestamp cannot be represented exactly as a BSON DateTime.
+const wkNanosField = "pb_nanos"
+
+// encodeWellKnownType writes m directly to vw using an idiomatic BSON shape
+// instead of the generic pb_field_N document, if m is one of the well-known
+// protobuf types. It reports handled=false for any other message, in which
+// case the caller should fall back to the generic encoding.
+//
+// Which well-known type m is, is decided from its descriptor's full name
+// rather than its Go type, matching how protojson does this dispatch (via
+// m.ProtoReflect().Descriptor().FullName()) — so a dynamicpb.Message built
+// from a well-known type's descriptor is handled the same as the generated
+// type. wireConvert adapts m into the concrete generated type the helpers
+// below expect; for a generated m it's just a wire round trip, not a
+// structural requirement.
+func (pc *protobufCodec) encodeWellKnownType(ectx bsoncodec.EncodeContext, vw bsonrw.ValueWriter, m proto.Message) (handled bool, err error) {
+	switch m.ProtoReflect().Descriptor().FullName() {
+	case "google.protobuf.Timestamp":
+		ts := &timestamppb.Timestamp{}
+		if err := wireConvert(m, ts); err != nil {
+			return true, err
+		}
+		return true, encodeTimestamp(vw, ts)
+	case "google.protobuf.Duration":
+		d := &durationpb.Duration{}
+		if err := wireConvert(m, d); err != nil {
+			return true, err
+		}
+		return true, vw.WriteInt64(d.AsDuration().Nanoseconds())
+	case "google.protobuf.BoolValue":
+		v := &wrapperspb.BoolValue{}
+		if err := wireConvert(m, v); err != nil {
+			return true, err
+		}
+		return true, vw.WriteBoolean(v.GetValue())
+	case "google.protobuf.Int32Value":
+		v := &wrapperspb.Int32Value{}
+		if err := wireConvert(m, v); err != nil {
+			return true, err
+		}
+		return true, vw.WriteInt32(v.GetValue())
+	case "google.protobuf.Int64Value":
+		v := &wrapperspb.Int64Value{}
+		if err := wireConvert(m, v); err != nil {
+			return true, err
+		}
+		return true, vw.WriteInt64(v.GetValue())
+	case "google.protobuf.UInt32Value":
+		v := &wrapperspb.UInt32Value{}
+		if err := wireConvert(m, v); err != nil {
+			return true, err
+		}
+		return true, vw.WriteInt64(int64(v.GetValue()))
+	case "google.protobuf.UInt64Value":
+		v := &wrapperspb.UInt64Value{}
+		if err := wireConvert(m, v); err != nil {
+			return true, err
+		}
+		return true, vw.WriteInt64(int64(v.GetValue()))
+	case "google.protobuf.FloatValue":
+		v := &wrapperspb.FloatValue{}
+		if err := wireConvert(m, v); err != nil {
+			return true, err
+		}
+		return true, vw.WriteDouble(float64(v.GetValue()))
+	case "google.protobuf.DoubleValue":
+		v := &wrapperspb.DoubleValue{}
+		if err := wireConvert(m, v); err != nil {
+			return true, err
+		}
+		return true, vw.WriteDouble(v.GetValue())
+	case "google.protobuf.StringValue":
+		v := &wrapperspb.StringValue{}
+		if err := wireConvert(m, v); err != nil {
+			return true, err
+		}
+		return true, vw.WriteString(v.GetValue())
+	case "google.protobuf.BytesValue":
+		v := &wrapperspb.BytesValue{}
+		if err := wireConvert(m, v); err != nil {
+			return true, err
+		}
+		return true, vw.WriteBinary(v.GetValue())
+	case "google.protobuf.FieldMask":
+		fm := &fieldmaskpb.FieldMask{}
+		if err := wireConvert(m, fm); err != nil {
+			return true, err
+		}
+		return true, vw.WriteString(strings.Join(fm.GetPaths(), ","))
+	case "google.protobuf.Empty":
+		return true, encodeEmpty(vw)
+	case "google.protobuf.Struct":
+		s := &structpb.Struct{}
+		if err := wireConvert(m, s); err != nil {
+			return true, err
+		}
+		return true, encodeStruct(vw, s)
+	case "google.protobuf.Value":
+		v := &structpb.Value{}
+		if err := wireConvert(m, v); err != nil {
+			return true, err
+		}
+		return true, encodeStructValue(vw, v)
+	case "google.protobuf.ListValue":
+		lv := &structpb.ListValue{}
+		if err := wireConvert(m, lv); err != nil {
+			return true, err
+		}
+		return true, encodeListValue(vw, lv)
+	case "google.protobuf.Any":
+		a := &anypb.Any{}
+		if err := wireConvert(m, a); err != nil {
+			return true, err
+		}
+		return true, pc.encodeAny(ectx, vw, a)
+	default:
+		return false, nil
+	}
+}
+
+// decodeWellKnownType is the decode-side counterpart of encodeWellKnownType;
+// see its doc comment for why dispatch is keyed on m's descriptor full name
+// rather than its Go type. Each case other than Empty decodes into a freshly
+// allocated concrete instance and then uses wireConvert to deposit the result
+// into m, which is a wire round trip rather than a direct write so that m may
+// be a dynamicpb.Message just as readily as the generated type. The Empty case
+// only consumes the document and leaves m as it is.
+func (pc *protobufCodec) decodeWellKnownType(dctx bsoncodec.DecodeContext, vr bsonrw.ValueReader, m proto.Message) (handled bool, err error) {
+	switch m.ProtoReflect().Descriptor().FullName() {
+	case "google.protobuf.Timestamp":
+		ts := &timestamppb.Timestamp{}
+		if err := decodeTimestamp(vr, ts); err != nil {
+			return true, err
+		}
+		return true, wireConvert(ts, m)
+	case "google.protobuf.Duration":
+		ns, err := vr.ReadInt64()
+		if err != nil {
+			return true, err
+		}
+		return true, wireConvert(durationpb.New(time.Duration(ns)), m)
+	case "google.protobuf.BoolValue":
+		v, err := vr.ReadBoolean()
+		if err != nil {
+			return true, err
+		}
+		return true, wireConvert(wrapperspb.Bool(v), m)
+	case "google.protobuf.Int32Value":
+		v, err := vr.ReadInt32()
+		if err != nil {
+			return true, err
+		}
+		return true, wireConvert(wrapperspb.Int32(v), m)
+	case "google.protobuf.Int64Value":
+		v, err := vr.ReadInt64()
+		if err != nil {
+			return true, err
+		}
+		return true, wireConvert(wrapperspb.Int64(v), m)
+	case "google.protobuf.UInt32Value":
+		v, err := vr.ReadInt64()
+		if err != nil {
+			return true, err
+		}
+		return true, wireConvert(wrapperspb.UInt32(uint32(v)), m)
+	case "google.protobuf.UInt64Value":
+		v, err := vr.ReadInt64()
+		if err != nil {
+			return true, err
+		}
+		return true, wireConvert(wrapperspb.UInt64(uint64(v)), m)
+	case "google.protobuf.FloatValue":
+		v, err := vr.ReadDouble()
+		if err != nil {
+			return true, err
+		}
+		return true, wireConvert(wrapperspb.Float(float32(v)), m)
+	case "google.protobuf.DoubleValue":
+		v, err := vr.ReadDouble()
+		if err != nil {
+			return true, err
+		}
+		return true, wireConvert(wrapperspb.Double(v), m)
+	case "google.protobuf.StringValue":
+		v, err := vr.ReadString()
+		if err != nil {
+			return true, err
+		}
+		return true, wireConvert(wrapperspb.String(v), m)
+	case "google.protobuf.BytesValue":
+		v, _, err := vr.ReadBinary()
+		if err != nil {
+			return true, err
+		}
+		return true, wireConvert(wrapperspb.Bytes(v), m)
+	case "google.protobuf.FieldMask":
+		s, err := vr.ReadString()
+		if err != nil {
+			return true, err
+		}
+		fm := &fieldmaskpb.FieldMask{}
+		if s != "" {
+			fm.Paths = strings.Split(s, ",")
+		}
+		return true, wireConvert(fm, m)
+	case "google.protobuf.Empty":
+		return true, decodeEmpty(vr)
+	case "google.protobuf.Struct":
+		s := &structpb.Struct{}
+		if err := decodeStruct(vr, s); err != nil {
+			return true, err
+		}
+		return true, wireConvert(s, m)
+	case "google.protobuf.Value":
+		v := &structpb.Value{}
+		if err := decodeStructValue(vr, v); err != nil {
+			return true, err
+		}
+		return true, wireConvert(v, m)
+	case "google.protobuf.ListValue":
+		lv := &structpb.ListValue{}
+		if err := decodeListValue(vr, lv); err != nil {
+			return true, err
+		}
+		return true, wireConvert(lv, m)
+	case "google.protobuf.Any":
+		a := &anypb.Any{}
+		if err := pc.decodeAny(dctx, vr, a); err != nil {
+			return true, err
+		}
+		return true, wireConvert(a, m)
+	default:
+		return false, nil
+	}
+}
+
+// wireConvert copies src's fields into dst via the wire format. Both src and
+// dst are expected to satisfy the same well-known type descriptor, so this
+// leaves dst equivalent to src regardless of whether either is backed by a
+// generated Go type or something like a dynamicpb.Message.
+func wireConvert(src, dst proto.Message) error {
+	b, err := proto.Marshal(src)
+	if err != nil {
+		return err
+	}
+	proto.Reset(dst)
+	return proto.Unmarshal(b, dst)
+}
+
+func encodeTimestamp(vw bsonrw.ValueWriter, ts *timestamppb.Timestamp) error {
+	t := ts.AsTime()
+	dt := primitive.NewDateTimeFromTime(t)
+	remainder := t.Nanosecond() % int(time.Millisecond)
+	if remainder == 0 {
+		return vw.WriteDateTime(int64(dt))
+	}
+
+	dw, err := vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+	dtw, err := dw.WriteDocumentElement("date")
+	if err != nil {
+		return err
+	}
+	if err = dtw.WriteDateTime(int64(dt)); err != nil {
+		return err
+	}
+	nw, err := dw.WriteDocumentElement(wkNanosField)
+	if err != nil {
+		return err
+	}
+	if err = nw.WriteInt32(int32(remainder)); err != nil {
+		return err
+	}
+	return dw.WriteDocumentEnd()
+}
+
+func decodeTimestamp(vr bsonrw.ValueReader, ts *timestamppb.Timestamp) error {
+	switch vr.Type() {
+	case bsontype.DateTime:
+		dt, err := vr.ReadDateTime()
+		if err != nil {
+			return err
+		}
+		*ts = *timestamppb.New(primitive.DateTime(dt).Time())
+		return nil
+	default:
+		dr, err := vr.ReadDocument()
+		if err != nil {
+			return err
+		}
+		var t time.Time
+		var nanos int32
+		for name, evr, err := dr.ReadElement(); err != bsonrw.ErrEOD; name, evr, err = dr.ReadElement() {
+			if err != nil {
+				return err
+			}
+			switch name {
+			case "date":
+				dt, err := evr.ReadDateTime()
+				if err != nil {
+					return err
+				}
+				t = primitive.DateTime(dt).Time()
+			case wkNanosField:
+				n, err := evr.ReadInt32()
+				if err != nil {
+					return err
+				}
+				nanos = n
+			default:
+				if err = evr.Skip(); err != nil {
+					return err
+				}
+			}
+		}
+		*ts = *timestamppb.New(t.Add(time.Duration(nanos)))
+		return nil
+	}
+}
+
+func encodeEmpty(vw bsonrw.ValueWriter) error {
+	dw, err := vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+	return dw.WriteDocumentEnd()
+}
+
+func decodeEmpty(vr bsonrw.ValueReader) error {
+	dr, err := vr.ReadDocument()
+	if err != nil {
+		return err
+	}
+	for _, evr, err := dr.ReadElement(); err != bsonrw.ErrEOD; _, evr, err = dr.ReadElement() {
+		if err != nil {
+			return err
+		}
+		if err = evr.Skip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeStruct(vw bsonrw.ValueWriter, s *structpb.Struct) error {
+	dw, err := vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(s.GetFields()))
+	for k := range s.GetFields() {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ew, err := dw.WriteDocumentElement(k)
+		if err != nil {
+			return err
+		}
+		if err = encodeStructValue(ew, s.Fields[k]); err != nil {
+			return err
+		}
+	}
+	return dw.WriteDocumentEnd()
+}
+
+func decodeStruct(vr bsonrw.ValueReader, s *structpb.Struct) error {
+	dr, err := vr.ReadDocument()
+	if err != nil {
+		return err
+	}
+	fields := make(map[string]*structpb.Value)
+	for name, evr, err := dr.ReadElement(); err != bsonrw.ErrEOD; name, evr, err = dr.ReadElement() {
+		if err != nil {
+			return err
+		}
+		v := &structpb.Value{}
+		if err = decodeStructValue(evr, v); err != nil {
+			return err
+		}
+		fields[name] = v
+	}
+	s.Fields = fields
+	return nil
+}
+
+func encodeStructValue(vw bsonrw.ValueWriter, v *structpb.Value) error {
+	switch k := v.GetKind().(type) {
+	case *structpb.Value_NullValue, nil:
+		return vw.WriteNull()
+	case *structpb.Value_NumberValue:
+		return vw.WriteDouble(k.NumberValue)
+	case *structpb.Value_StringValue:
+		return vw.WriteString(k.StringValue)
+	case *structpb.Value_BoolValue:
+		return vw.WriteBoolean(k.BoolValue)
+	case *structpb.Value_StructValue:
+		return encodeStruct(vw, k.StructValue)
+	case *structpb.Value_ListValue:
+		return encodeListValue(vw, k.ListValue)
+	default:
+		return fmt.Errorf("protobson: unknown structpb.Value kind %T", k)
+	}
+}
+
+func decodeStructValue(vr bsonrw.ValueReader, v *structpb.Value) error {
+	switch vr.Type() {
+	case bsontype.Null:
+		if err := vr.ReadNull(); err != nil {
+			return err
+		}
+		v.Kind = &structpb.Value_NullValue{}
+	case bsontype.Double:
+		d, err := vr.ReadDouble()
+		if err != nil {
+			return err
+		}
+		v.Kind = &structpb.Value_NumberValue{NumberValue: d}
+	case bsontype.String:
+		s, err := vr.ReadString()
+		if err != nil {
+			return err
+		}
+		v.Kind = &structpb.Value_StringValue{StringValue: s}
+	case bsontype.Boolean:
+		b, err := vr.ReadBoolean()
+		if err != nil {
+			return err
+		}
+		v.Kind = &structpb.Value_BoolValue{BoolValue: b}
+	case bsontype.Array:
+		lv := &structpb.ListValue{}
+		if err := decodeListValue(vr, lv); err != nil {
+			return err
+		}
+		v.Kind = &structpb.Value_ListValue{ListValue: lv}
+	default:
+		sv := &structpb.Struct{}
+		if err := decodeStruct(vr, sv); err != nil {
+			return err
+		}
+		v.Kind = &structpb.Value_StructValue{StructValue: sv}
+	}
+	return nil
+}
+
+func encodeListValue(vw bsonrw.ValueWriter, lv *structpb.ListValue) error {
+	aw, err := vw.WriteArray()
+	if err != nil {
+		return err
+	}
+	for _, v := range lv.GetValues() {
+		evw, err := aw.WriteArrayElement()
+		if err != nil {
+			return err
+		}
+		if err = encodeStructValue(evw, v); err != nil {
+			return err
+		}
+	}
+	return aw.WriteArrayEnd()
+}
+
+func decodeListValue(vr bsonrw.ValueReader, lv *structpb.ListValue) error {
+	ar, err := vr.ReadArray()
+	if err != nil {
+		return err
+	}
+	var values []*structpb.Value
+	for evr, err := ar.ReadValue(); err != bsonrw.ErrEOA; evr, err = ar.ReadValue() {
+		if err != nil {
+			return err
+		}
+		v := &structpb.Value{}
+		if err = decodeStructValue(evr, v); err != nil {
+			return err
+		}
+		values = append(values, v)
+	}
+	lv.Values = values
+	return nil
+}
+
+// encodeAny encodes the message nested inside a, using pc itself (rather
+// than a bare codec) to encode it, so that every CodecOption configured on
+// the outer codec — well-known type handling, NameStrategy, and so on —
+// also applies to the payload of an Any.
+func (pc *protobufCodec) encodeAny(ectx bsoncodec.EncodeContext, vw bsonrw.ValueWriter, a *anypb.Any) error {
+	dw, err := vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+	uw, err := dw.WriteDocumentElement("type_url")
+	if err != nil {
+		return err
+	}
+	if err = uw.WriteString(a.GetTypeUrl()); err != nil {
+		return err
+	}
+
+	vvw, err := dw.WriteDocumentElement("value")
+	if err != nil {
+		return err
+	}
+	if inner, err := a.UnmarshalNew(); err == nil {
+		if err = pc.EncodeValue(ectx, vvw, reflect.ValueOf(inner)); err != nil {
+			return err
+		}
+	} else if err = vvw.WriteBinary(a.GetValue()); err != nil {
+		return err
+	}
+	return dw.WriteDocumentEnd()
+}
+
+// decodeAny is the decode-side counterpart of encodeAny; see its doc comment.
+func (pc *protobufCodec) decodeAny(dctx bsoncodec.DecodeContext, vr bsonrw.ValueReader, a *anypb.Any) error {
+	dr, err := vr.ReadDocument()
+	if err != nil {
+		return err
+	}
+	var typeURL string
+	var valueVR bsonrw.ValueReader
+	for name, evr, err := dr.ReadElement(); err != bsonrw.ErrEOD; name, evr, err = dr.ReadElement() {
+		if err != nil {
+			return err
+		}
+		switch name {
+		case "type_url":
+			if typeURL, err = evr.ReadString(); err != nil {
+				return err
+			}
+		case "value":
+			// evr must be consumed before the next ReadElement call, so its
+			// raw bytes are copied out and replayed once type_url is known.
+			t, data, err := bsonrw.Copier{}.CopyValueToBytes(evr)
+			if err != nil {
+				return err
+			}
+			valueVR = bsonrw.NewBSONValueReader(t, data)
+		default:
+			if err = evr.Skip(); err != nil {
+				return err
+			}
+		}
+	}
+	a.TypeUrl = typeURL
+
+	if valueVR == nil {
+		return nil
+	}
+	if valueVR.Type() == bsontype.Binary {
+		b, _, err := valueVR.ReadBinary()
+		a.Value = b
+		return err
+	}
+
+	mt, err := protoregistry.GlobalTypes.FindMessageByURL(typeURL)
+	if err != nil {
+		// Unknown type: fall back to storing the BSON value verbatim is not
+		// possible without losing type information, so surface the lookup error.
+		return fmt.Errorf("protobson: decoding Any with type_url %q: %w", typeURL, err)
+	}
+	inner := mt.New().Interface()
+	if err = pc.DecodeValue(dctx, valueVR, reflect.ValueOf(inner)); err != nil {
+		return err
+	}
+	b, err := proto.Marshal(inner)
+	if err != nil {
+		return err
+	}
+	a.Value = b
+	return nil
+}
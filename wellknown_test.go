@@ -0,0 +1,163 @@
+package protobson
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	pb_test "github.com/tesspib/protobson/test"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func newWellKnownRegistry() *bsoncodec.Registry {
+	typ := reflect.TypeOf((*proto.Message)(nil)).Elem()
+	codec := NewCodec()
+	rb := bson.NewRegistryBuilder()
+	return rb.RegisterHookDecoder(typ, codec).RegisterHookEncoder(typ, codec).Build()
+}
+
+func TestWellKnownTypesMarshalUnmarshal(t *testing.T) {
+	now := time.Date(2024, 3, 2, 1, 0, 0, 0, time.UTC)
+
+	anyDuration, err := anypb.New(durationpb.New(90 * time.Second))
+	if err != nil {
+		t.Fatalf("anypb.New error = %v", err)
+	}
+
+	wellKnownTests := []struct {
+		name string
+		pb   proto.Message
+	}{
+		{name: "timestamp", pb: timestamppb.New(now)},
+		{name: "timestamp with nanos", pb: timestamppb.New(now.Add(123456))},
+		{name: "duration", pb: durationpb.New(90 * time.Second)},
+		{name: "any", pb: anyDuration},
+		{name: "string value", pb: wrapperspb.String("hello")},
+		{name: "int32 value", pb: wrapperspb.Int32(42)},
+		{
+			name: "struct",
+			pb: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"a": structpb.NewStringValue("b"),
+				"n": structpb.NewNumberValue(3.5),
+				"l": structpb.NewListValue(&structpb.ListValue{Values: []*structpb.Value{
+					structpb.NewBoolValue(true),
+					structpb.NewNullValue(),
+				}}),
+			}},
+		},
+	}
+
+	reg := newWellKnownRegistry()
+	for _, tc := range wellKnownTests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := bson.MarshalWithRegistry(reg, tc.pb)
+			if err != nil {
+				t.Fatalf("bson.MarshalWithRegistry error = %v", err)
+			}
+
+			out := reflect.New(reflect.TypeOf(tc.pb).Elem()).Interface().(proto.Message)
+			if err = bson.UnmarshalWithRegistry(reg, b, &out); err != nil {
+				t.Fatalf("bson.UnmarshalWithRegistry error = %v", err)
+			}
+			if !proto.Equal(tc.pb, out) {
+				t.Errorf("failed: in=%#q, out=%#q", tc.pb, out)
+			}
+		})
+	}
+}
+
+func TestWellKnownTypesDisabled(t *testing.T) {
+	typ := reflect.TypeOf((*proto.Message)(nil)).Elem()
+	codec := NewCodec(WithWellKnownTypes(false))
+	rb := bson.NewRegistryBuilder()
+	reg := rb.RegisterHookDecoder(typ, codec).RegisterHookEncoder(typ, codec).Build()
+
+	ts := timestamppb.New(time.Unix(1000, 0))
+	b, err := bson.MarshalWithRegistry(reg, ts)
+	if err != nil {
+		t.Fatalf("bson.MarshalWithRegistry error = %v", err)
+	}
+	if v := bson.Raw(b).Lookup("pb_field_1"); v.Value == nil {
+		t.Errorf("expected generic pb_field_1 encoding when well-known types are disabled, got %v", bson.Raw(b))
+	}
+}
+
+// TestWellKnownTypesDynamicMessageDispatchedByFullName guards against
+// encodeWellKnownType/decodeWellKnownType dispatching on m's Go type instead
+// of its descriptor's full name: a dynamicpb.Message built from the real
+// google.protobuf.Timestamp descriptor (as protoc-gen-go-never-generated
+// code, or a message read from an unknown-at-compile-time schema, might
+// produce) must get the same idiomatic BSON encoding as *timestamppb.Timestamp,
+// not fall through to the generic pb_field_N document.
+func TestWellKnownTypesDynamicMessageDispatchedByFullName(t *testing.T) {
+	desc := (&timestamppb.Timestamp{}).ProtoReflect().Descriptor()
+	now := time.Date(2024, 3, 2, 1, 0, 0, 0, time.UTC)
+
+	in := dynamicpb.NewMessage(desc)
+	in.Set(desc.Fields().ByName("seconds"), protoreflect.ValueOfInt64(now.Unix()))
+
+	reg := newWellKnownRegistry()
+	b, err := bson.MarshalWithRegistry(reg, in)
+	if err != nil {
+		t.Fatalf("bson.MarshalWithRegistry error = %v", err)
+	}
+
+	out := dynamicpb.NewMessage(desc)
+	outMsg := proto.Message(out)
+	if err = bson.UnmarshalWithRegistry(reg, b, &outMsg); err != nil {
+		t.Fatalf("bson.UnmarshalWithRegistry error = %v", err)
+	}
+	if !proto.Equal(in, outMsg) {
+		t.Errorf("failed: in=%#q, out=%#q", in, outMsg)
+	}
+
+	ts := &timestamppb.Timestamp{}
+	if err = bson.UnmarshalWithRegistry(reg, b, &ts); err != nil {
+		t.Fatalf("bson.UnmarshalWithRegistry into generated type error = %v", err)
+	}
+	if !ts.AsTime().Equal(now) {
+		t.Errorf("decoded into generated type = %v, want %v", ts.AsTime(), now)
+	}
+}
+
+// TestNameStrategyAppliesInsideAny guards against encodeAny and decodeAny
+// reusing a bare, unconfigured codec for the message nested in an Any: every
+// CodecOption set on the outer codec must also govern the payload. It uses
+// WithNameStrategy rather than WithWellKnownTypes(false), since the latter
+// turns off the idiomatic Any encoding itself.
+func TestNameStrategyAppliesInsideAny(t *testing.T) {
+	typ := reflect.TypeOf((*proto.Message)(nil)).Elem()
+	codec := NewCodec(WithNameStrategy(ProtoFieldNames{}))
+	rb := bson.NewRegistryBuilder()
+	reg := rb.RegisterHookDecoder(typ, codec).RegisterHookEncoder(typ, codec).Build()
+
+	in, err := anypb.New(&pb_test.SimpleMessage{StringField: "foo"})
+	if err != nil {
+		t.Fatalf("anypb.New error = %v", err)
+	}
+	b, err := bson.MarshalWithRegistry(reg, in)
+	if err != nil {
+		t.Fatalf("bson.MarshalWithRegistry error = %v", err)
+	}
+	value := bson.Raw(b).Lookup("value")
+	if v := value.Document().Lookup("string_field"); v.Value == nil {
+		t.Errorf("expected ProtoFieldNames encoding inside Any, got %v", value)
+	}
+
+	out := &anypb.Any{}
+	if err = bson.UnmarshalWithRegistry(reg, b, &out); err != nil {
+		t.Fatalf("bson.UnmarshalWithRegistry error = %v", err)
+	}
+	if !proto.Equal(in, out) {
+		t.Errorf("failed: in=%#q, out=%#q", in, out)
+	}
+}